@@ -0,0 +1,38 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+// Package errors defines the sentinel errors shared across BR.
+package errors
+
+// Error is a sentinel error; Equal compares identity, so an error wrapped (e.g. via
+// errors.Annotatef) only matches after unwrapping it with errors.Cause.
+type Error struct {
+	message string
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+// Equal reports whether err is this same sentinel error.
+func (e *Error) Equal(err error) bool {
+	target, ok := err.(*Error)
+	return ok && target == e
+}
+
+var (
+	// ErrBackupGCSafepointExceeded is returned when the intended backup TS is already older
+	// than the cluster's GC safe point.
+	ErrBackupGCSafepointExceeded = &Error{"backup GC safepoint exceeded"}
+	// ErrInvalidArgument is returned when a caller passes an argument an API can't act on.
+	ErrInvalidArgument = &Error{"invalid argument"}
+	// ErrPDGCSafePointNotExist stands for PD reporting that a keyspace or service group has
+	// never had a GC safe point set. The safe point helpers in pkg/utils detect that case from
+	// PD's error message and do not return this error.
+	ErrPDGCSafePointNotExist = &Error{"pd gc safe point not exist"}
+	// ErrBackupGCSafepointLost is returned by UpdateServiceSafePoint in strict mode when PD
+	// didn't accept our safe point, i.e. it was evicted or never held.
+	ErrBackupGCSafepointLost = &Error{"backup gc safepoint lost"}
+	// ErrServiceSafePointAlreadyEvicted is returned by UnblockGC when PD reports the safe
+	// point was already gone, distinguishing that from a normal, fresh removal.
+	ErrServiceSafePointAlreadyEvicted = &Error{"service safe point already evicted"}
+)
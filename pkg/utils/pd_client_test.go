@@ -0,0 +1,101 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// fakePDClient is a minimal pd.Client double for exercising the safe point helpers without a
+// real PD cluster. Each method delegates to an optional hook field so individual tests only
+// need to stub the calls they care about; unset hooks return a zero value and a nil error.
+type fakePDClient struct {
+	mu sync.Mutex
+
+	updateGCSafePointFunc        func(ctx context.Context, safePoint uint64) (uint64, error)
+	updateServiceGCSafePointFunc func(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error)
+	updateGCSafePointV2Func      func(ctx context.Context, keyspaceID uint32, safePoint uint64) (uint64, error)
+	updateServiceSafePointV2Func func(ctx context.Context, keyspaceID uint32, serviceID string, ttl int64, safePoint uint64) (uint64, error)
+	getTSFunc                    func(ctx context.Context) (int64, int64, error)
+
+	getAllServiceGroupsFunc             func(ctx context.Context) ([]string, error)
+	getMinServiceSafePointByGroupFunc   func(ctx context.Context, groupID string) (uint64, int64, error)
+	updateServiceSafePointByGroupFunc   func(ctx context.Context, groupID, serviceID string, ttl int64, ts uint64) (uint64, error)
+	updateGCSafePointByServiceGroupFunc func(ctx context.Context, groupID string, ts uint64, revision int64) (bool, uint64, error)
+
+	// calls counts invocations of UpdateServiceGCSafePoint, for asserting retry bounds.
+	calls int
+}
+
+func (f *fakePDClient) UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error) {
+	if f.updateGCSafePointFunc != nil {
+		return f.updateGCSafePointFunc(ctx, safePoint)
+	}
+	return 0, nil
+}
+
+func (f *fakePDClient) UpdateServiceGCSafePoint(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+	if f.updateServiceGCSafePointFunc != nil {
+		return f.updateServiceGCSafePointFunc(ctx, serviceID, ttl, safePoint)
+	}
+	return 0, nil
+}
+
+func (f *fakePDClient) UpdateGCSafePointV2(ctx context.Context, keyspaceID uint32, safePoint uint64) (uint64, error) {
+	if f.updateGCSafePointV2Func != nil {
+		return f.updateGCSafePointV2Func(ctx, keyspaceID, safePoint)
+	}
+	return 0, nil
+}
+
+func (f *fakePDClient) UpdateServiceSafePointV2(ctx context.Context, keyspaceID uint32, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+	if f.updateServiceSafePointV2Func != nil {
+		return f.updateServiceSafePointV2Func(ctx, keyspaceID, serviceID, ttl, safePoint)
+	}
+	return 0, nil
+}
+
+func (f *fakePDClient) GetTS(ctx context.Context) (int64, int64, error) {
+	if f.getTSFunc != nil {
+		return f.getTSFunc(ctx)
+	}
+	return 0, 0, nil
+}
+
+func (f *fakePDClient) GetAllServiceGroups(ctx context.Context) ([]string, error) {
+	if f.getAllServiceGroupsFunc != nil {
+		return f.getAllServiceGroupsFunc(ctx)
+	}
+	return nil, nil
+}
+
+func (f *fakePDClient) GetMinServiceSafePointByServiceGroup(ctx context.Context, groupID string) (uint64, int64, error) {
+	if f.getMinServiceSafePointByGroupFunc != nil {
+		return f.getMinServiceSafePointByGroupFunc(ctx, groupID)
+	}
+	return 0, 0, nil
+}
+
+func (f *fakePDClient) UpdateServiceSafePointByServiceGroup(ctx context.Context, groupID, serviceID string, ttl int64, ts uint64) (uint64, error) {
+	if f.updateServiceSafePointByGroupFunc != nil {
+		return f.updateServiceSafePointByGroupFunc(ctx, groupID, serviceID, ttl, ts)
+	}
+	return 0, nil
+}
+
+func (f *fakePDClient) UpdateGCSafePointByServiceGroup(ctx context.Context, groupID string, ts uint64, revision int64) (bool, uint64, error) {
+	if f.updateGCSafePointByServiceGroupFunc != nil {
+		return f.updateGCSafePointByServiceGroupFunc(ctx, groupID, ts, revision)
+	}
+	return false, 0, nil
+}
+
+func (f *fakePDClient) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
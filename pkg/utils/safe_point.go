@@ -5,12 +5,13 @@ package utils
 import (
 	"context"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
-	pd "github.com/tikv/pd/client"
 	"github.com/tikv/pd/pkg/tsoutil"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -18,19 +19,64 @@ import (
 	berrors "github.com/Orion7r/pr/pkg/errors"
 )
 
+// safePointPDClient is implemented by pd.Client; the safe point helpers only need this subset
+// of its much larger surface (region/store/TSO/etc.), so we depend on this instead, the same
+// way asRawKVSafePointClient narrows pd.Client for the RawKV methods.
+type safePointPDClient interface {
+	UpdateGCSafePoint(ctx context.Context, safePoint uint64) (uint64, error)
+	UpdateServiceGCSafePoint(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error)
+	UpdateGCSafePointV2(ctx context.Context, keyspaceID uint32, safePoint uint64) (uint64, error)
+	UpdateServiceSafePointV2(ctx context.Context, keyspaceID uint32, serviceID string, ttl int64, safePoint uint64) (uint64, error)
+	GetTS(ctx context.Context) (int64, int64, error)
+}
+
 const (
-	brServiceSafePointIDFormat      = "br-%s"
-	preUpdateServiceSafePointFactor = 3
-	checkGCSafePointGapTime         = 5 * time.Second
+	brServiceSafePointIDFormat         = "br-%s"
+	brKeyspaceServiceSafePointIDFormat = "br-ks%d-%s"
+	preUpdateServiceSafePointFactor    = 3
+	checkGCSafePointGapTime            = 5 * time.Second
 	// DefaultBRGCSafePointTTL means PD keep safePoint limit at least 5min.
 	DefaultBRGCSafePointTTL = 5 * 60
+	// NullKeyspaceID is used in BRServiceSafePoint.KeyspaceID to mean "this safe point is
+	// cluster-wide", i.e. not scoped to any particular keyspace.
+	NullKeyspaceID = uint32(math.MaxUint32)
+
+	updateSafePointRetryCount = 3
 )
 
+// updateSafePointRetryBackoff is a var, not a const, so tests can shrink it.
+var updateSafePointRetryBackoff = time.Second
+
 // BRServiceSafePoint is metadata of service safe point from a BR 'instance'.
 type BRServiceSafePoint struct {
 	ID       string
 	TTL      int64
 	BackupTS uint64
+
+	// KeyspaceID scopes this safe point to a single keyspace, so BR can back up or restore
+	// one keyspace without pinning GC for the whole cluster. Leave it as NullKeyspaceID for
+	// the legacy cluster-wide behavior.
+	KeyspaceID uint32
+
+	// Strict makes UpdateServiceSafePoint fail with ErrBackupGCSafepointLost instead of just
+	// logging a warning when PD reports our safe point was not accepted.
+	Strict bool
+
+	// ServiceGroupID scopes this safe point to a RawKV service group instead of the legacy
+	// TxnKV GC namespace. Leave it empty for the legacy TxnKV GC.
+	ServiceGroupID string
+}
+
+// IsKeyspaceScoped returns whether this safe point is pinned to a single keyspace's GC safe
+// point rather than the cluster-wide one.
+func (sp BRServiceSafePoint) IsKeyspaceScoped() bool {
+	return sp.KeyspaceID != NullKeyspaceID
+}
+
+// IsServiceGroupScoped returns whether this safe point belongs to a RawKV service group
+// rather than the legacy TxnKV GC namespace.
+func (sp BRServiceSafePoint) IsServiceGroupScoped() bool {
+	return sp.ServiceGroupID != ""
 }
 
 // MarshalLogObject implements zapcore.ObjectMarshaler.
@@ -41,12 +87,18 @@ func (sp BRServiceSafePoint) MarshalLogObject(encoder zapcore.ObjectEncoder) err
 	backupTime, _ := tsoutil.ParseTS(sp.BackupTS)
 	encoder.AddString("BackupTime", backupTime.String())
 	encoder.AddUint64("BackupTS", sp.BackupTS)
+	if sp.IsKeyspaceScoped() {
+		encoder.AddUint32("KeyspaceID", sp.KeyspaceID)
+	}
+	if sp.IsServiceGroupScoped() {
+		encoder.AddString("ServiceGroupID", sp.ServiceGroupID)
+	}
 	return nil
 }
 
 // getGCSafePoint returns the current gc safe point.
 // TODO: Some cluster may not enable distributed GC.
-func getGCSafePoint(ctx context.Context, pdClient pd.Client) (uint64, error) {
+func getGCSafePoint(ctx context.Context, pdClient safePointPDClient) (uint64, error) {
 	safePoint, err := pdClient.UpdateGCSafePoint(ctx, 0)
 	if err != nil {
 		return 0, errors.Trace(err)
@@ -54,14 +106,44 @@ func getGCSafePoint(ctx context.Context, pdClient pd.Client) (uint64, error) {
 	return safePoint, nil
 }
 
+// pdSafePointNotExistMsg is the substring PD's gRPC error carries when a keyspace or service
+// group has never had a GC safe point set. The vendored pd client doesn't expose this as a
+// typed error, so we match on the message instead of comparing against our own local sentinel.
+const pdSafePointNotExistMsg = "doesn't exist"
+
+// isPDSafePointNotExist reports whether err is PD's response for "no safe point registered yet".
+func isPDSafePointNotExist(err error) bool {
+	return err != nil && strings.Contains(err.Error(), pdSafePointNotExistMsg)
+}
+
+// getKeyspaceGCSafePoint returns the current GC safe point of the given keyspace, mirroring
+// getGCSafePoint but reading PD's keyspace-scoped GC safe point instead of the cluster one.
+func getKeyspaceGCSafePoint(ctx context.Context, pdClient safePointPDClient, keyspaceID uint32) (uint64, error) {
+	safePoint, err := pdClient.UpdateGCSafePointV2(ctx, keyspaceID, 0)
+	if err != nil {
+		if isPDSafePointNotExist(err) {
+			// The keyspace has never had a GC safe point set, treat it as zero.
+			return 0, nil
+		}
+		return 0, errors.Trace(err)
+	}
+	return safePoint, nil
+}
+
 // MakeSafePointID makes a unique safe point ID, for reduce name conflict.
 func MakeSafePointID() string {
 	return fmt.Sprintf(brServiceSafePointIDFormat, uuid.New())
 }
 
+// MakeKeyspaceSafePointID makes a unique safe point ID scoped to keyspaceID, so that
+// keyspaces sharing the same PD cluster don't collide on service safe point IDs.
+func MakeKeyspaceSafePointID(keyspaceID uint32) string {
+	return fmt.Sprintf(brKeyspaceServiceSafePointIDFormat, keyspaceID, uuid.New())
+}
+
 // CheckGCSafePoint checks whether the ts is older than GC safepoint.
 // Note: It ignores errors other than exceed GC safepoint.
-func CheckGCSafePoint(ctx context.Context, pdClient pd.Client, ts uint64) error {
+func CheckGCSafePoint(ctx context.Context, pdClient safePointPDClient, ts uint64) error {
 	// TODO: use PDClient.GetGCSafePoint instead once PD client exports it.
 	safePoint, err := getGCSafePoint(ctx, pdClient)
 	if err != nil {
@@ -74,14 +156,52 @@ func CheckGCSafePoint(ctx context.Context, pdClient pd.Client, ts uint64) error
 	return nil
 }
 
+// CheckKeyspaceGCSafePoint checks whether the ts is older than the GC safe point of the
+// given keyspace. Note: like CheckGCSafePoint, it ignores errors other than exceed GC safepoint.
+func CheckKeyspaceGCSafePoint(ctx context.Context, pdClient safePointPDClient, keyspaceID uint32, ts uint64) error {
+	safePoint, err := getKeyspaceGCSafePoint(ctx, pdClient, keyspaceID)
+	if err != nil {
+		log.Warn("fail to get keyspace GC safe point", zap.Uint32("keyspaceID", keyspaceID), zap.Error(err))
+		return nil
+	}
+	if ts <= safePoint {
+		return errors.Annotatef(berrors.ErrBackupGCSafepointExceeded,
+			"keyspace %d GC safepoint %d exceed TS %d", keyspaceID, safePoint, ts)
+	}
+	return nil
+}
+
+// registerServiceSafePoint makes the raw PD call registering sp, dispatching by scope.
+func registerServiceSafePoint(ctx context.Context, pdClient safePointPDClient, sp BRServiceSafePoint) (uint64, error) {
+	switch {
+	case sp.IsServiceGroupScoped():
+		rkv, err := asRawKVSafePointClient(pdClient)
+		if err != nil {
+			return 0, err
+		}
+		return rkv.UpdateServiceSafePointByServiceGroup(ctx,
+			sp.ServiceGroupID, sp.ID, sp.TTL, sp.BackupTS-1)
+	case sp.IsKeyspaceScoped():
+		return pdClient.UpdateServiceSafePointV2(ctx,
+			sp.KeyspaceID, sp.ID, sp.TTL, sp.BackupTS-1)
+	default:
+		return pdClient.UpdateServiceGCSafePoint(ctx,
+			sp.ID, sp.TTL, sp.BackupTS-1)
+	}
+}
+
 // UpdateServiceSafePoint register BackupTS to PD, to lock down BackupTS as safePoint with TTL seconds.
-func UpdateServiceSafePoint(ctx context.Context, pdClient pd.Client, sp BRServiceSafePoint) error {
+func UpdateServiceSafePoint(ctx context.Context, pdClient safePointPDClient, sp BRServiceSafePoint) error {
 	log.Debug("update PD safePoint limit with TTL",
 		zap.Object("safePoint", sp))
 
-	lastSafePoint, err := pdClient.UpdateServiceGCSafePoint(ctx,
-		sp.ID, sp.TTL, sp.BackupTS-1)
+	lastSafePoint, err := registerServiceSafePoint(ctx, pdClient, sp)
 	if lastSafePoint > sp.BackupTS-1 {
+		if sp.Strict {
+			return errors.Annotatef(berrors.ErrBackupGCSafepointLost,
+				"service GC safe point lost: PD only accepted safe point %d, wanted %d",
+				lastSafePoint, sp.BackupTS-1)
+		}
 		log.Warn("service GC safe point lost, we may fail to back up if GC lifetime isn't long enough",
 			zap.Uint64("lastSafePoint", lastSafePoint),
 			zap.Object("safePoint", sp),
@@ -90,46 +210,190 @@ func UpdateServiceSafePoint(ctx context.Context, pdClient pd.Client, sp BRServic
 	return errors.Trace(err)
 }
 
+// updateServiceSafePointWithRetry calls UpdateServiceSafePoint, retrying a bounded number of
+// times with backoff on transient PD errors. It gives up immediately on ErrBackupGCSafepointLost,
+// since retrying won't un-evict an already-lost safe point.
+func updateServiceSafePointWithRetry(ctx context.Context, pdClient safePointPDClient, sp BRServiceSafePoint) error {
+	backoff := updateSafePointRetryBackoff
+	var err error
+	for attempt := 1; attempt <= updateSafePointRetryCount; attempt++ {
+		err = UpdateServiceSafePoint(ctx, pdClient, sp)
+		if err == nil || berrors.ErrBackupGCSafepointLost.Equal(errors.Cause(err)) {
+			return err
+		}
+		log.Warn("failed to update service safe point, will retry",
+			zap.Int("attempt", attempt), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// UnblockGC removes the service safe point id from PD immediately (TTL=0) instead of waiting
+// for it to expire. It returns ErrServiceSafePointAlreadyEvicted if PD reports it already gone.
+func UnblockGC(ctx context.Context, pdClient safePointPDClient, id string) error {
+	return unblockGC(ctx, pdClient, BRServiceSafePoint{ID: id, KeyspaceID: NullKeyspaceID})
+}
+
+// UnblockKeyspaceGC is UnblockGC for a keyspace-scoped service safe point.
+func UnblockKeyspaceGC(ctx context.Context, pdClient safePointPDClient, id string, keyspaceID uint32) error {
+	return unblockGC(ctx, pdClient, BRServiceSafePoint{ID: id, KeyspaceID: keyspaceID})
+}
+
+// UnblockServiceGroupGC is UnblockGC for a RawKV service-group-scoped service safe point.
+func UnblockServiceGroupGC(ctx context.Context, pdClient safePointPDClient, groupID, serviceID string) error {
+	return unblockGC(ctx, pdClient, BRServiceSafePoint{ID: serviceID, KeyspaceID: NullKeyspaceID, ServiceGroupID: groupID})
+}
+
+func unblockGC(ctx context.Context, pdClient safePointPDClient, sp BRServiceSafePoint) error {
+	var err error
+	switch {
+	case sp.IsServiceGroupScoped():
+		var rkv rawKVSafePointClient
+		if rkv, err = asRawKVSafePointClient(pdClient); err == nil {
+			_, err = rkv.UpdateServiceSafePointByServiceGroup(ctx, sp.ServiceGroupID, sp.ID, 0, 0)
+		}
+	case sp.IsKeyspaceScoped():
+		_, err = pdClient.UpdateServiceSafePointV2(ctx, sp.KeyspaceID, sp.ID, 0, 0)
+	default:
+		_, err = pdClient.UpdateServiceGCSafePoint(ctx, sp.ID, 0, 0)
+	}
+	if err != nil {
+		if isPDSafePointNotExist(err) {
+			return errors.Annotatef(berrors.ErrServiceSafePointAlreadyEvicted,
+				"service safe point %s was already evicted before UnblockGC", sp.ID)
+		}
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// SafePointKeeper is a handle to a running service safe point keeper goroutine, returned by
+// StartServiceSafePointKeeper.
+type SafePointKeeper struct {
+	sp       BRServiceSafePoint
+	pdClient safePointPDClient
+	cancel   context.CancelFunc
+	done     chan struct{}
+	errCh    chan error
+}
+
+// Err returns a channel that receives at most one error: when sp.Strict is set and PD reports
+// our safe point was evicted, the keeper reports ErrBackupGCSafepointLost here and stops, and
+// when the periodic GC safe point check finds BackupTS already passed, it reports
+// ErrBackupGCSafepointExceeded here and stops, so the caller can cancel the backup job instead
+// of the keeper panicking.
+func (k *SafePointKeeper) Err() <-chan error {
+	return k.errCh
+}
+
+// Stop cancels the keeper goroutine and releases the service safe point from PD immediately.
+func (k *SafePointKeeper) Stop() error {
+	k.cancel()
+	<-k.done
+	return unblockGC(context.Background(), k.pdClient, k.sp)
+}
+
 // StartServiceSafePointKeeper will run UpdateServiceSafePoint periodicity
-// hence keeping service safepoint won't lose.
+// hence keeping service safepoint won't lose. Use the returned keeper's Stop method to release
+// the safe point immediately, and its Err channel to learn if Strict mode reported the safe
+// point lost or passed by GC.
 func StartServiceSafePointKeeper(
 	ctx context.Context,
-	pdClient pd.Client,
+	pdClient safePointPDClient,
+	sp BRServiceSafePoint,
+) *SafePointKeeper {
+	return startServiceSafePointKeeper(ctx, pdClient, sp, false)
+}
+
+// startServiceSafePointKeeper is StartServiceSafePointKeeper, except alreadyRegistered lets a
+// caller that just registered sp itself (e.g. ReserveSafePoint) skip the keeper's otherwise
+// redundant first registration RPC.
+func startServiceSafePointKeeper(
+	ctx context.Context,
+	pdClient safePointPDClient,
 	sp BRServiceSafePoint,
-) {
+	alreadyRegistered bool,
+) *SafePointKeeper {
+	ctx, cancel := context.WithCancel(ctx)
+	keeper := &SafePointKeeper{
+		sp:       sp,
+		pdClient: pdClient,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		errCh:    make(chan error, 1),
+	}
 	// It would be OK since TTL won't be zero, so gapTime should > `0.
 	updateGapTime := time.Duration(sp.TTL) * time.Second / preUpdateServiceSafePointFactor
-	update := func(ctx context.Context) {
-		if err := UpdateServiceSafePoint(ctx, pdClient, sp); err != nil {
-			log.Warn("failed to update service safe point, backup may fail if gc triggered",
-				zap.Error(err),
-			)
+	update := func(ctx context.Context) bool {
+		err := updateServiceSafePointWithRetry(ctx, pdClient, sp)
+		if err == nil {
+			return true
+		}
+		if sp.Strict && berrors.ErrBackupGCSafepointLost.Equal(errors.Cause(err)) {
+			keeper.errCh <- err
+			return false
 		}
+		log.Warn("failed to update service safe point, backup may fail if gc triggered",
+			zap.Error(err),
+		)
+		return true
 	}
-	check := func(ctx context.Context) {
-		if err := CheckGCSafePoint(ctx, pdClient, sp.BackupTS); err != nil {
-			log.Panic("cannot pass gc safe point check, aborting",
-				zap.Error(err),
-				zap.Object("safePoint", sp),
-			)
+	check := func(ctx context.Context) bool {
+		if sp.IsServiceGroupScoped() {
+			// RawKV service groups don't have a single cluster GC safe point to race
+			// against the way TxnKV does; UpdateServiceSafePointByServiceGroup already
+			// guards against it being evicted on every tick.
+			return true
+		}
+		var err error
+		if sp.IsKeyspaceScoped() {
+			err = CheckKeyspaceGCSafePoint(ctx, pdClient, sp.KeyspaceID, sp.BackupTS)
+		} else {
+			err = CheckGCSafePoint(ctx, pdClient, sp.BackupTS)
+		}
+		if err == nil {
+			return true
 		}
+		if sp.Strict {
+			keeper.errCh <- err
+			return false
+		}
+		log.Panic("cannot pass gc safe point check, aborting",
+			zap.Error(err),
+			zap.Object("safePoint", sp),
+		)
+		return false
 	}
 	updateTick := time.NewTicker(updateGapTime)
 	checkTick := time.NewTicker(checkGCSafePointGapTime)
-	update(ctx)
 	go func() {
+		defer close(keeper.done)
+		defer close(keeper.errCh)
 		defer updateTick.Stop()
 		defer checkTick.Stop()
+		if !alreadyRegistered && !update(ctx) {
+			return
+		}
 		for {
 			select {
 			case <-ctx.Done():
 				log.Debug("service safe point keeper exited")
 				return
 			case <-updateTick.C:
-				update(ctx)
+				if !update(ctx) {
+					return
+				}
 			case <-checkTick.C:
-				check(ctx)
+				if !check(ctx) {
+					return
+				}
 			}
 		}
 	}()
+	return keeper
 }
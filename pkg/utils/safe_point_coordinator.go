@@ -0,0 +1,237 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/Orion7r/pr/pkg/errors"
+)
+
+// DefaultSafePointCoordinatorGraceDuration is how long a failed task's last reported
+// checkpoint keeps holding back the coordinated safe point before it is ignored.
+const DefaultSafePointCoordinatorGraceDuration = 24 * time.Hour
+
+// physicalShiftBits is the number of bits the physical part of a TSO is shifted by, matching
+// the encoding tsoutil.ParseTS decodes.
+const physicalShiftBits = 18
+
+// SafePointCoordinatorHandle identifies a task registered with a ServiceSafePointCoordinator.
+type SafePointCoordinatorHandle struct {
+	taskID string
+}
+
+// CoordinatorMetrics is a snapshot of a ServiceSafePointCoordinator's internal state, suitable
+// for exporting as metrics.
+type CoordinatorMetrics struct {
+	ActiveTasks      int
+	FailedTasks      int
+	SafePoint        uint64
+	GapToGCSafePoint int64
+	GapToGCSafeKnown bool
+}
+
+type coordinatorTask struct {
+	checkpoint uint64
+	failed     bool
+}
+
+// ServiceSafePointCoordinator multiplexes many concurrent BR tasks behind a single service
+// safe point, collapsing their checkpoints into one service safe point update per tick instead
+// of each task running its own StartServiceSafePointKeeper.
+type ServiceSafePointCoordinator struct {
+	pdClient safePointPDClient
+	sp       BRServiceSafePoint
+	grace    time.Duration
+
+	mu      sync.Mutex
+	tasks   map[string]*coordinatorTask
+	metrics CoordinatorMetrics
+
+	errCh chan error
+}
+
+// NewServiceSafePointCoordinator creates a coordinator that registers sp.ID with PD and
+// advances it according to the tasks registered through Register/Advance. grace controls how
+// long a failed task continues to hold back the safe point; pass 0 to use
+// DefaultSafePointCoordinatorGraceDuration.
+func NewServiceSafePointCoordinator(pdClient safePointPDClient, sp BRServiceSafePoint, grace time.Duration) *ServiceSafePointCoordinator {
+	if grace <= 0 {
+		grace = DefaultSafePointCoordinatorGraceDuration
+	}
+	return &ServiceSafePointCoordinator{
+		pdClient: pdClient,
+		sp:       sp,
+		grace:    grace,
+		tasks:    make(map[string]*coordinatorTask),
+		errCh:    make(chan error, 1),
+	}
+}
+
+// Err returns a channel that receives at most one error: when sp.Strict is set and PD reports
+// the coordinated safe point was evicted, Run reports ErrBackupGCSafepointLost here and stops,
+// mirroring SafePointKeeper.Err.
+func (c *ServiceSafePointCoordinator) Err() <-chan error {
+	return c.errCh
+}
+
+// Register adds a new task to the coordinator, initially holding the safe point at backupTS.
+func (c *ServiceSafePointCoordinator) Register(taskID string, backupTS uint64) (SafePointCoordinatorHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.tasks[taskID]; ok {
+		return SafePointCoordinatorHandle{}, errors.Annotatef(berrors.ErrInvalidArgument, "task %s is already registered", taskID)
+	}
+	c.tasks[taskID] = &coordinatorTask{checkpoint: backupTS}
+	return SafePointCoordinatorHandle{taskID: taskID}, nil
+}
+
+// Advance moves a task's checkpoint forward to ts, releasing the safe point up to that point.
+// It also clears any prior failed state, since a task that can still advance is healthy again.
+func (c *ServiceSafePointCoordinator) Advance(handle SafePointCoordinatorHandle, ts uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	task, ok := c.tasks[handle.taskID]
+	if !ok {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "task %s is not registered", handle.taskID)
+	}
+	task.checkpoint = ts
+	task.failed = false
+	return nil
+}
+
+// Fail marks a task as failed: its checkpoint keeps holding back the safe point only for the
+// coordinator's grace period, after which it is ignored.
+func (c *ServiceSafePointCoordinator) Fail(handle SafePointCoordinatorHandle) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	task, ok := c.tasks[handle.taskID]
+	if !ok {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "task %s is not registered", handle.taskID)
+	}
+	task.failed = true
+	return nil
+}
+
+// Unregister removes a task from the coordinator; it no longer influences the safe point.
+func (c *ServiceSafePointCoordinator) Unregister(handle SafePointCoordinatorHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tasks, handle.taskID)
+}
+
+// Metrics returns a snapshot of the coordinator's state as of its last tick that updated the
+// safe point with PD; ticks with no registered tasks or a failed update leave it unchanged.
+func (c *ServiceSafePointCoordinator) Metrics() CoordinatorMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metrics
+}
+
+// Run runs the coordinator's loop in the calling goroutine, advancing the registered service
+// safe point at TTL/preUpdateServiceSafePointFactor cadence. It returns when ctx is cancelled,
+// or when sp.Strict is set and the safe point is reported lost on Err.
+func (c *ServiceSafePointCoordinator) Run(ctx context.Context) {
+	gapTime := time.Duration(c.sp.TTL) * time.Second / preUpdateServiceSafePointFactor
+	ticker := time.NewTicker(gapTime)
+	defer ticker.Stop()
+	defer close(c.errCh)
+	if !c.tick(ctx) {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("service safe point coordinator exited")
+			return
+		case <-ticker.C:
+			if !c.tick(ctx) {
+				return
+			}
+		}
+	}
+}
+
+// tick advances the coordinated safe point once; it returns false when sp.Strict is set and
+// PD reported the safe point lost, meaning Run should stop after reporting the error on errCh.
+func (c *ServiceSafePointCoordinator) tick(ctx context.Context) bool {
+	c.mu.Lock()
+	if len(c.tasks) == 0 {
+		c.mu.Unlock()
+		return true
+	}
+	safePoint, activeCnt, failedCnt := c.computeSafePointLocked()
+	c.mu.Unlock()
+
+	sp := c.sp
+	sp.BackupTS = safePoint + 1
+	if err := UpdateServiceSafePoint(ctx, c.pdClient, sp); err != nil {
+		if sp.Strict && berrors.ErrBackupGCSafepointLost.Equal(errors.Cause(err)) {
+			c.errCh <- err
+			return false
+		}
+		log.Warn("failed to advance coordinated service safe point", zap.Error(err))
+		return true
+	}
+
+	metrics := CoordinatorMetrics{ActiveTasks: activeCnt, FailedTasks: failedCnt, SafePoint: safePoint}
+	if gcSafePoint, err := getGCSafePoint(ctx, c.pdClient); err == nil {
+		metrics.GapToGCSafePoint = int64(safePoint) - int64(gcSafePoint)
+		metrics.GapToGCSafeKnown = true
+	}
+
+	c.mu.Lock()
+	c.metrics = metrics
+	c.mu.Unlock()
+
+	log.Debug("advanced coordinated service safe point",
+		zap.Uint64("safePoint", safePoint),
+		zap.Int("activeTasks", activeCnt),
+		zap.Int("failedTasks", failedCnt),
+	)
+	return true
+}
+
+// computeSafePointLocked implements min(activeMinTS, max(failedMinTS, now-GraceDuration)):
+// healthy tasks hold the safe point at their minimum checkpoint, while failed tasks only hold
+// it back for c.grace past now, after which they're ignored. c.mu must be held.
+func (c *ServiceSafePointCoordinator) computeSafePointLocked() (safePoint uint64, activeCnt, failedCnt int) {
+	var activeMin, failedMin uint64 = math.MaxUint64, math.MaxUint64
+	for _, task := range c.tasks {
+		if task.failed {
+			failedCnt++
+			if task.checkpoint < failedMin {
+				failedMin = task.checkpoint
+			}
+		} else {
+			activeCnt++
+			if task.checkpoint < activeMin {
+				activeMin = task.checkpoint
+			}
+		}
+	}
+	graceFloor := timeToTS(time.Now().Add(-c.grace))
+	failedFloor := failedMin
+	if failedFloor < graceFloor {
+		failedFloor = graceFloor
+	}
+	safePoint = activeMin
+	if failedFloor < safePoint {
+		safePoint = failedFloor
+	}
+	return safePoint, activeCnt, failedCnt
+}
+
+// timeToTS approximates a TSO for t with a zero logical part, suitable as a lower bound when
+// comparing against real TSO-derived checkpoints.
+func timeToTS(t time.Time) uint64 {
+	physical := t.UnixNano() / int64(time.Millisecond)
+	return uint64(physical) << physicalShiftBits
+}
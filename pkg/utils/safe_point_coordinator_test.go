@@ -0,0 +1,57 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeSafePointLockedUsesActiveMinWhenBelowGraceFloor(t *testing.T) {
+	pdClient := &fakePDClient{}
+	c := NewServiceSafePointCoordinator(pdClient, BRServiceSafePoint{ID: "t"}, time.Hour)
+	c.tasks["active"] = &coordinatorTask{checkpoint: 100}
+	c.tasks["failed"] = &coordinatorTask{checkpoint: 50, failed: true}
+
+	safePoint, activeCnt, failedCnt := c.computeSafePointLocked()
+	if activeCnt != 1 || failedCnt != 1 {
+		t.Fatalf("got activeCnt=%d failedCnt=%d, want 1, 1", activeCnt, failedCnt)
+	}
+	// The failed task's checkpoint (50) is below the grace floor (now - 1h, a huge TS), so
+	// the floor wins over it, and the active min (100) is still the smallest overall.
+	if safePoint != 100 {
+		t.Fatalf("got safePoint=%d, want 100 (active min, since grace floor > failed checkpoint)", safePoint)
+	}
+}
+
+func TestComputeSafePointLockedUsesGraceFloorForStaleFailedTask(t *testing.T) {
+	pdClient := &fakePDClient{}
+	// A 1ns grace period puts the floor at about "now", well past any test checkpoint, so the
+	// failed task's stale checkpoint no longer holds the safe point back. (A zero grace would
+	// be replaced by the 24h default.)
+	c := NewServiceSafePointCoordinator(pdClient, BRServiceSafePoint{ID: "t"}, time.Nanosecond)
+	c.tasks["active"] = &coordinatorTask{checkpoint: 9999999999}
+	c.tasks["failed"] = &coordinatorTask{checkpoint: 1, failed: true}
+
+	safePoint, _, _ := c.computeSafePointLocked()
+	if safePoint != 9999999999 {
+		t.Fatalf("got safePoint=%d, want the active min (failed task's stale checkpoint should be floored away)", safePoint)
+	}
+}
+
+func TestComputeSafePointLockedWithOnlyFailedTasksUsesFailedMin(t *testing.T) {
+	pdClient := &fakePDClient{}
+	c := NewServiceSafePointCoordinator(pdClient, BRServiceSafePoint{ID: "t"}, time.Hour)
+	ts1 := timeToTS(time.Now())
+	ts2 := timeToTS(time.Now().Add(time.Minute))
+	c.tasks["failed1"] = &coordinatorTask{checkpoint: ts1, failed: true}
+	c.tasks["failed2"] = &coordinatorTask{checkpoint: ts2, failed: true}
+
+	safePoint, activeCnt, failedCnt := c.computeSafePointLocked()
+	if activeCnt != 0 || failedCnt != 2 {
+		t.Fatalf("got activeCnt=%d failedCnt=%d, want 0, 2", activeCnt, failedCnt)
+	}
+	if safePoint != ts1 {
+		t.Fatalf("got safePoint=%d, want %d (min of the failed tasks, grace floor not yet reached)", safePoint, ts1)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/tikv/pd/pkg/tsoutil"
+	"go.uber.org/zap"
+
+	berrors "github.com/Orion7r/pr/pkg/errors"
+)
+
+// ReserveSafePoint atomically registers sp with PD and starts its keeper, closing the race
+// window between a CheckGCSafePoint check and a later UpdateServiceSafePoint call. If PD
+// rejects the registration, it removes the reservation (TTL=0) before returning
+// ErrBackupGCSafepointExceeded.
+func ReserveSafePoint(ctx context.Context, pdClient safePointPDClient, sp BRServiceSafePoint) (*SafePointKeeper, error) {
+	lastSafePoint, err := registerServiceSafePoint(ctx, pdClient, sp)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if lastSafePoint > sp.BackupTS-1 {
+		if unblockErr := unblockGC(ctx, pdClient, sp); unblockErr != nil {
+			log.Warn("failed to remove rejected safe point reservation",
+				zap.Object("safePoint", sp), zap.Error(unblockErr))
+		}
+		return nil, errors.Annotatef(berrors.ErrBackupGCSafepointExceeded,
+			"GC safepoint %d exceed BackupTS %d", lastSafePoint, sp.BackupTS)
+	}
+	return startServiceSafePointKeeper(ctx, pdClient, sp, true), nil
+}
+
+// ReserveLatest fetches a fresh TSO from PD and reserves it as a service safe point under
+// idPrefix, the common "back up as of now" case.
+func ReserveLatest(ctx context.Context, pdClient safePointPDClient, idPrefix string, ttl int64) (uint64, *SafePointKeeper, error) {
+	physical, logical, err := pdClient.GetTS(ctx)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	ts := tsoutil.ComposeTS(physical, logical)
+	keeper, err := ReserveSafePoint(ctx, pdClient, BRServiceSafePoint{
+		ID:         fmt.Sprintf("%s-%s", idPrefix, uuid.New()),
+		TTL:        ttl,
+		BackupTS:   ts,
+		KeyspaceID: NullKeyspaceID,
+	})
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	return ts, keeper, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/errors"
+
+	berrors "github.com/Orion7r/pr/pkg/errors"
+)
+
+func TestReserveSafePointRollsBackOnRejection(t *testing.T) {
+	var calls []uint64
+	pdClient := &fakePDClient{
+		updateServiceGCSafePointFunc: func(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+			calls = append(calls, safePoint)
+			if len(calls) == 1 {
+				// Reject the reservation: PD already holds a higher safe point.
+				return 200, nil
+			}
+			return 0, nil
+		},
+	}
+	sp := BRServiceSafePoint{ID: "t1", TTL: 10, BackupTS: 100, KeyspaceID: NullKeyspaceID}
+
+	keeper, err := ReserveSafePoint(context.Background(), pdClient, sp)
+	if keeper != nil {
+		t.Fatal("expected no keeper on a rejected reservation")
+	}
+	if !berrors.ErrBackupGCSafepointExceeded.Equal(errors.Cause(err)) {
+		t.Fatalf("got error %v, want ErrBackupGCSafepointExceeded", err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("got %d calls, want 2 (register, then rollback)", len(calls))
+	}
+	if calls[1] != 0 {
+		t.Fatalf("rollback call used safePoint %d, want 0 (TTL=0 removal)", calls[1])
+	}
+}
+
+func TestReserveSafePointStartsKeeperOnAcceptance(t *testing.T) {
+	pdClient := &fakePDClient{
+		updateServiceGCSafePointFunc: func(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+			return safePoint, nil
+		},
+	}
+	sp := BRServiceSafePoint{ID: "t1", TTL: 10, BackupTS: 100, KeyspaceID: NullKeyspaceID}
+
+	keeper, err := ReserveSafePoint(context.Background(), pdClient, sp)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keeper == nil {
+		t.Fatal("expected a keeper on an accepted reservation")
+	}
+	if err := keeper.Stop(); err != nil {
+		t.Fatalf("unexpected error stopping keeper: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+)
+
+// rawKVSafePointClient is implemented by pd.Client values that also support PD's RawKV
+// service-group safe point API. Unlike the keyspace V2 methods, this isn't part of
+// safePointPDClient, so we type-assert for it instead of assuming every client has it.
+type rawKVSafePointClient interface {
+	GetAllServiceGroups(ctx context.Context) ([]string, error)
+	GetMinServiceSafePointByServiceGroup(ctx context.Context, groupID string) (uint64, int64, error)
+	UpdateServiceSafePointByServiceGroup(ctx context.Context, groupID, serviceID string, ttl int64, ts uint64) (uint64, error)
+	UpdateGCSafePointByServiceGroup(ctx context.Context, groupID string, ts uint64, revision int64) (bool, uint64, error)
+}
+
+func asRawKVSafePointClient(pdClient safePointPDClient) (rawKVSafePointClient, error) {
+	rkv, ok := pdClient.(rawKVSafePointClient)
+	if !ok {
+		return nil, errors.New("pd client does not support RawKV service-group safe points")
+	}
+	return rkv, nil
+}
+
+// GetAllServiceGroups returns every service group PD knows about, e.g. the groups RawKV GC
+// workers register.
+func GetAllServiceGroups(ctx context.Context, pdClient safePointPDClient) ([]string, error) {
+	rkv, err := asRawKVSafePointClient(pdClient)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := rkv.GetAllServiceGroups(ctx)
+	return groups, errors.Trace(err)
+}
+
+// GetMinServiceSafePointByServiceGroup returns groupID's minimum service safe point and the
+// revision PD used to compute it, for use as a compare-and-swap guard in a later
+// UpdateGCSafePointByServiceGroup call.
+func GetMinServiceSafePointByServiceGroup(ctx context.Context, pdClient safePointPDClient, groupID string) (uint64, int64, error) {
+	rkv, err := asRawKVSafePointClient(pdClient)
+	if err != nil {
+		return 0, 0, err
+	}
+	ts, revision, err := rkv.GetMinServiceSafePointByServiceGroup(ctx, groupID)
+	return ts, revision, errors.Trace(err)
+}
+
+// UpdateServiceSafePointByServiceGroup registers serviceID's safe point ts within groupID for
+// ttl seconds, mirroring UpdateServiceSafePoint against PD's RawKV GC namespace instead of the
+// TxnKV one. It returns the resulting minimum safe point across the group.
+func UpdateServiceSafePointByServiceGroup(
+	ctx context.Context, pdClient safePointPDClient, groupID, serviceID string, ttl int64, ts uint64,
+) (uint64, error) {
+	rkv, err := asRawKVSafePointClient(pdClient)
+	if err != nil {
+		return 0, err
+	}
+	min, err := rkv.UpdateServiceSafePointByServiceGroup(ctx, groupID, serviceID, ttl, ts)
+	return min, errors.Trace(err)
+}
+
+// UpdateGCSafePointByServiceGroup advances groupID's GC safe point to ts via PD's
+// revision-based compare-and-swap, succeeding only if revision still matches what PD last
+// reported for the group.
+func UpdateGCSafePointByServiceGroup(
+	ctx context.Context, pdClient safePointPDClient, groupID string, ts uint64, revision int64,
+) (succeeded bool, newSafePoint uint64, err error) {
+	rkv, err := asRawKVSafePointClient(pdClient)
+	if err != nil {
+		return false, 0, err
+	}
+	succeeded, newSafePoint, err = rkv.UpdateGCSafePointByServiceGroup(ctx, groupID, ts, revision)
+	return succeeded, newSafePoint, errors.Trace(err)
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+
+	berrors "github.com/Orion7r/pr/pkg/errors"
+)
+
+func TestUpdateServiceSafePointWithRetryGivesUpAfterRetryCount(t *testing.T) {
+	old := updateSafePointRetryBackoff
+	updateSafePointRetryBackoff = time.Millisecond
+	defer func() { updateSafePointRetryBackoff = old }()
+
+	wantErr := errors.New("pd unavailable")
+	pdClient := &fakePDClient{
+		updateServiceGCSafePointFunc: func(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+			return 0, wantErr
+		},
+	}
+	sp := BRServiceSafePoint{ID: "t1", TTL: 10, BackupTS: 100, KeyspaceID: NullKeyspaceID}
+
+	err := updateServiceSafePointWithRetry(context.Background(), pdClient, sp)
+	if err == nil {
+		t.Fatal("expected an error after exhausting retries")
+	}
+	if got := pdClient.callCount(); got != updateSafePointRetryCount {
+		t.Fatalf("got %d calls, want %d", got, updateSafePointRetryCount)
+	}
+}
+
+func TestUpdateServiceSafePointWithRetryStopsImmediatelyOnSafepointLost(t *testing.T) {
+	old := updateSafePointRetryBackoff
+	updateSafePointRetryBackoff = time.Millisecond
+	defer func() { updateSafePointRetryBackoff = old }()
+
+	pdClient := &fakePDClient{
+		updateServiceGCSafePointFunc: func(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+			return safePoint + 1, nil
+		},
+	}
+	sp := BRServiceSafePoint{ID: "t1", TTL: 10, BackupTS: 100, KeyspaceID: NullKeyspaceID, Strict: true}
+
+	err := updateServiceSafePointWithRetry(context.Background(), pdClient, sp)
+	if !berrors.ErrBackupGCSafepointLost.Equal(errors.Cause(err)) {
+		t.Fatalf("got error %v, want ErrBackupGCSafepointLost", err)
+	}
+	if got := pdClient.callCount(); got != 1 {
+		t.Fatalf("got %d calls, want 1 (no retries after safepoint lost)", got)
+	}
+}
+
+func TestStartServiceSafePointKeeperReportsSafepointLostInStrictMode(t *testing.T) {
+	pdClient := &fakePDClient{
+		updateServiceGCSafePointFunc: func(ctx context.Context, serviceID string, ttl int64, safePoint uint64) (uint64, error) {
+			return safePoint + 1, nil
+		},
+	}
+	sp := BRServiceSafePoint{ID: "t1", TTL: 3, BackupTS: 100, KeyspaceID: NullKeyspaceID, Strict: true}
+
+	keeper := StartServiceSafePointKeeper(context.Background(), pdClient, sp)
+	select {
+	case err := <-keeper.Err():
+		if !berrors.ErrBackupGCSafepointLost.Equal(errors.Cause(err)) {
+			t.Fatalf("got error %v, want ErrBackupGCSafepointLost", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("keeper did not report the lost safe point")
+	}
+}